@@ -0,0 +1,125 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
+)
+
+// MetricsSink lets callers plug a metrics backend (Prometheus, OpenTelemetry, or
+// anything else) into the latency tracking done by latencyStats, without forking this
+// package. The default, installed until SetMetricsSink is called, is a no-op so that
+// tracking latency costs nothing when metrics are disabled.
+type MetricsSink interface {
+	// ObserveLatency reports one request's latency in milliseconds, the same unit
+	// latencyStats.observe expects. role is one of "leader", "follower", or "learner".
+	ObserveLatency(storeID, regionID uint64, reqType, role string, latencyMs uint64)
+	// Flush gives sinks that buffer data, e.g. to batch network writes, a chance to push
+	// what they have. Sinks that report synchronously can leave it a no-op.
+	Flush()
+}
+
+type noopMetricsSink struct{}
+
+func (noopMetricsSink) ObserveLatency(_, _ uint64, _, _ string, _ uint64) {}
+func (noopMetricsSink) Flush()                                            {}
+
+// metricsSinkHolder is the fixed concrete type stored in globalMetricsSink. atomic.Value
+// panics if the dynamic type of successive Store calls changes, which it would if we
+// stored a MetricsSink directly: init stores noopMetricsSink{} and SetMetricsSink stores
+// whatever concrete sink the caller passes in. Wrapping the interface in a struct keeps
+// the stored type constant across every Store call.
+type metricsSinkHolder struct {
+	sink MetricsSink
+}
+
+var globalMetricsSink atomic.Value
+
+func init() {
+	globalMetricsSink.Store(metricsSinkHolder{sink: noopMetricsSink{}})
+}
+
+// SetMetricsSink swaps the MetricsSink that latencyStats.observe reports to. Passing nil
+// restores the no-op default.
+func SetMetricsSink(sink MetricsSink) {
+	if sink == nil {
+		sink = noopMetricsSink{}
+	}
+	globalMetricsSink.Store(metricsSinkHolder{sink: sink})
+}
+
+func currentMetricsSink() MetricsSink {
+	return globalMetricsSink.Load().(metricsSinkHolder).sink
+}
+
+// PrometheusMetricsSink is the bundled MetricsSink implementation. It reports every
+// observed latency into a HistogramVec, and additionally exposes the decayed
+// WeightedAvg/WeightedPercentile view of a store's stats as gauges for callers that
+// periodically refresh them (e.g. alongside ReplicaScorer.Observe).
+type PrometheusMetricsSink struct {
+	latency *prometheus.HistogramVec
+	avg     *prometheus.GaugeVec
+	p99     *prometheus.GaugeVec
+}
+
+// NewPrometheusMetricsSink creates a PrometheusMetricsSink and registers its collectors
+// with reg, e.g. prometheus.DefaultRegisterer.
+func NewPrometheusMetricsSink(reg prometheus.Registerer) *PrometheusMetricsSink {
+	sink := &PrometheusMetricsSink{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "tikv_client",
+			Subsystem: "region_request",
+			Name:      "latency_seconds",
+			Help:      "Latency of requests sent to a TiKV store, by store, request type, and replica role.",
+			// 1ms to ~8s, doubling each step.
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+			// region is deliberately not a label: with potentially millions of regions
+			// per cluster it would blow up Prometheus' cardinality.
+		}, []string{"store", "req_type", "role"}),
+		avg: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tikv_client",
+			Subsystem: "region_request",
+			Name:      "latency_weighted_avg_ms",
+			Help:      "Decayed weighted average latency per store, see Stats.WeightedAvg.",
+		}, []string{"store"}),
+		p99: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "tikv_client",
+			Subsystem: "region_request",
+			Name:      "latency_weighted_p99_ms",
+			Help:      "Decayed weighted P99 latency per store, see Stats.WeightedPercentile.",
+		}, []string{"store"}),
+	}
+	reg.MustRegister(sink.latency, sink.avg, sink.p99)
+	return sink
+}
+
+// ObserveLatency implements MetricsSink.
+func (p *PrometheusMetricsSink) ObserveLatency(storeID, _ uint64, reqType, role string, latencyMs uint64) {
+	p.latency.WithLabelValues(strconv.FormatUint(storeID, 10), reqType, role).Observe(float64(latencyMs) / 1000)
+}
+
+// Flush implements MetricsSink; Prometheus scrapes pull, so there is nothing to push.
+func (p *PrometheusMetricsSink) Flush() {}
+
+// ReportStoreStats updates the avg/P99 gauges for storeID from its latest Stats
+// snapshot, typically obtained from latencyStats.getLatestStats.
+func (p *PrometheusMetricsSink) ReportStoreStats(storeID uint64, stats Stats) {
+	label := strconv.FormatUint(storeID, 10)
+	p.avg.WithLabelValues(label).Set(float64(stats.WeightedAvg()))
+	p.p99.WithLabelValues(label).Set(float64(stats.WeightedPercentile(99)))
+}
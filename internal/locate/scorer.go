@@ -0,0 +1,268 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// ReplicaScorerConfig holds the tunables for ReplicaScorer's EWMA scoring and outlier
+// ejection.
+type ReplicaScorerConfig struct {
+	// EMAHalfLife is the half-life of the exponentially weighted moving average kept per
+	// store, smoothing scores so a single latencyStats bucket rollover doesn't cause
+	// scores to jitter.
+	EMAHalfLife time.Duration
+	// EjectionThreshold is the number of standard deviations a store's EWMA score may
+	// exceed the mean of its healthy peers before it is ejected, mirroring Envoy's
+	// success-rate outlier detection.
+	EjectionThreshold float64
+	// BaseEjectionDuration is the cooldown applied the first time a store is ejected; it
+	// doubles on every consecutive ejection up to MaxEjectionDuration.
+	BaseEjectionDuration time.Duration
+	MaxEjectionDuration  time.Duration
+}
+
+// DefaultReplicaScorerConfig is the tuning used when NewReplicaScorer is called without
+// an explicit config.
+var DefaultReplicaScorerConfig = ReplicaScorerConfig{
+	EMAHalfLife:          30 * time.Second,
+	EjectionThreshold:    1.9,
+	BaseEjectionDuration: 30 * time.Second,
+	MaxEjectionDuration:  5 * time.Minute,
+}
+
+// storeScore is the scoring state ReplicaScorer keeps for a single store.
+type storeScore struct {
+	mu sync.Mutex
+
+	ema    float64
+	hasEMA bool
+	lastTs time.Time
+
+	ejectedUntil      time.Time
+	consecutiveEjects int
+}
+
+// ewmaDecay converts a half-life and elapsed duration into the weight the previous EMA
+// value keeps: weight = 0.5^(elapsed/halfLife). In the limit elapsed -> 0 no time has
+// passed, so the old value should be kept in full (weight 1), not discarded.
+func ewmaDecay(halfLife, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 1
+	}
+	if halfLife <= 0 {
+		return 0
+	}
+	return math.Exp2(-float64(elapsed) / float64(halfLife))
+}
+
+func (s *storeScore) observe(now time.Time, value float64, cfg ReplicaScorerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.hasEMA {
+		s.ema = value
+		s.hasEMA = true
+	} else {
+		w := ewmaDecay(cfg.EMAHalfLife, now.Sub(s.lastTs))
+		s.ema = s.ema*w + value*(1-w)
+	}
+	s.lastTs = now
+}
+
+// score returns the current EWMA and whether the store has ever been observed. A store
+// with no data yet (ok == false) must not be treated as scoring 0: callers that compare
+// scores should only do so among stores where ok is true, falling back to an unscored
+// store only once no scored one is left.
+func (s *storeScore) score() (value float64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ema, s.hasEMA
+}
+
+func (s *storeScore) isEjected(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Before(s.ejectedUntil)
+}
+
+func (s *storeScore) eject(now time.Time, cfg ReplicaScorerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// eject is only called on a store that isEjected reported healthy, i.e. its previous
+	// cooldown (if any) has already expired. Only treat this as a fresh offence, and
+	// reset the streak, once the store has stayed healthy for a full cooldown period; a
+	// store that relapses sooner than that keeps escalating toward MaxEjectionDuration.
+	if now.Sub(s.ejectedUntil) > cfg.BaseEjectionDuration {
+		s.consecutiveEjects = 0
+	}
+	cooldown := cfg.BaseEjectionDuration << s.consecutiveEjects
+	if cooldown <= 0 || cooldown > cfg.MaxEjectionDuration {
+		cooldown = cfg.MaxEjectionDuration
+	}
+	s.ejectedUntil = now.Add(cooldown)
+	s.consecutiveEjects++
+}
+
+// ReplicaScorer ranks the peers of a region by recent latency. It smooths latencyStats'
+// per-store WeightedAvg with an EWMA and temporarily ejects peers whose score is an
+// outlier among their healthy siblings, in the style of Envoy's success-rate outlier
+// detection.
+//
+// Nothing in this package calls Observe or Pick: ReplicaScorer is not connected to any
+// replica selection path, including follower reads and stale reads, and it only ranks
+// peers for callers that feed it stats and call Pick themselves.
+type ReplicaScorer struct {
+	cfg ReplicaScorerConfig
+
+	mu     sync.RWMutex
+	stores map[uint64]*storeScore
+}
+
+// NewReplicaScorer creates a ReplicaScorer using DefaultReplicaScorerConfig.
+func NewReplicaScorer() *ReplicaScorer {
+	return NewReplicaScorerWithConfig(DefaultReplicaScorerConfig)
+}
+
+// NewReplicaScorerWithConfig creates a ReplicaScorer with custom tunables.
+func NewReplicaScorerWithConfig(cfg ReplicaScorerConfig) *ReplicaScorer {
+	return &ReplicaScorer{
+		cfg:    cfg,
+		stores: make(map[uint64]*storeScore),
+	}
+}
+
+func (r *ReplicaScorer) storeScoreFor(storeID uint64) *storeScore {
+	r.mu.RLock()
+	s := r.stores[storeID]
+	r.mu.RUnlock()
+	if s != nil {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s = r.stores[storeID]; s == nil {
+		s = &storeScore{}
+		r.stores[storeID] = s
+	}
+	return s
+}
+
+// Observe feeds a store's latest latencyStats into the scorer's EWMA. Callers should
+// invoke this whenever they refresh a store's stats, typically right after
+// latencyStats.getLatestStats.
+func (r *ReplicaScorer) Observe(storeID uint64, stats Stats, now time.Time) {
+	avg := stats.WeightedAvg()
+	if avg == 0 {
+		return
+	}
+	r.storeScoreFor(storeID).observe(now, float64(avg), r.cfg)
+}
+
+// ejectOutliers computes the mean and stddev of the EWMA score across peers that are not
+// already ejected, then ejects any peer whose score exceeds mean+k*stddev.
+func (r *ReplicaScorer) ejectOutliers(peers []*metapb.Peer, now time.Time) {
+	if len(peers) < 3 {
+		// outlier detection needs enough healthy peers for the mean/stddev to be meaningful.
+		return
+	}
+	scores := make([]float64, 0, len(peers))
+	healthy := make([]*storeScore, 0, len(peers))
+	for _, p := range peers {
+		s := r.storeScoreFor(p.GetStoreId())
+		if s.isEjected(now) {
+			continue
+		}
+		sc, ok := s.score()
+		if !ok {
+			// no data yet for this store: it has no EWMA to compare against its peers'
+			// and must not be treated as a healthy 0, nor be eligible for ejection.
+			continue
+		}
+		scores = append(scores, sc)
+		healthy = append(healthy, s)
+	}
+	if len(scores) < 3 {
+		return
+	}
+	mean, stddev := meanStdDev(scores)
+	threshold := mean + r.cfg.EjectionThreshold*stddev
+	for i, sc := range scores {
+		if sc > threshold {
+			healthy[i].eject(now, r.cfg)
+		}
+	}
+}
+
+func meanStdDev(values []float64) (mean, stddev float64) {
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		d := v - mean
+		stddev += d * d
+	}
+	stddev = math.Sqrt(stddev / float64(len(values)))
+	return mean, stddev
+}
+
+// Pick selects the best peer to send a request to: it ejects any peer whose score is a
+// latency outlier among its siblings, then returns the non-ejected peer with the lowest
+// EWMA score. A peer with no data yet (never observed, or observed too rarely for
+// WeightedAvg to leave its 100-sample warm-up) is treated as neutral rather than as
+// scoring 0: it is only returned if every scored peer is ejected or no peer has data at
+// all, so a persistently slow store can't win forever just because it's rarely hit. Pick
+// returns false only when peers is empty.
+func (r *ReplicaScorer) Pick(peers []*metapb.Peer) (*metapb.Peer, bool) {
+	if len(peers) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	r.ejectOutliers(peers, now)
+
+	var best, fallback *metapb.Peer
+	bestScore := math.Inf(1)
+	for _, p := range peers {
+		s := r.storeScoreFor(p.GetStoreId())
+		if s.isEjected(now) {
+			continue
+		}
+		sc, ok := s.score()
+		if !ok {
+			if fallback == nil {
+				fallback = p
+			}
+			continue
+		}
+		if best == nil || sc < bestScore {
+			best, bestScore = p, sc
+		}
+	}
+	switch {
+	case best != nil:
+		return best, true
+	case fallback != nil:
+		return fallback, true
+	default:
+		// every peer is currently ejected; fall back to the first one rather than
+		// failing the request outright.
+		return peers[0], true
+	}
+}
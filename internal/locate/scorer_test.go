@@ -0,0 +1,73 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEwmaDecay(t *testing.T) {
+	halfLife := 30 * time.Second
+	if w := ewmaDecay(halfLife, 0); w != 1 {
+		t.Errorf("elapsed=0: weight = %v, want 1", w)
+	}
+	if w := ewmaDecay(0, time.Second); w != 0 {
+		t.Errorf("halfLife=0: weight = %v, want 0", w)
+	}
+	if w := ewmaDecay(halfLife, halfLife); w < 0.49 || w > 0.51 {
+		t.Errorf("elapsed=halfLife: weight = %v, want ~0.5", w)
+	}
+	if w := ewmaDecay(halfLife, 2*halfLife); w < 0.24 || w > 0.26 {
+		t.Errorf("elapsed=2*halfLife: weight = %v, want ~0.25", w)
+	}
+}
+
+func TestEjectCooldownDoubles(t *testing.T) {
+	cfg := DefaultReplicaScorerConfig
+	cfg.BaseEjectionDuration = time.Second
+	cfg.MaxEjectionDuration = 8 * time.Second
+
+	s := &storeScore{}
+	now := time.Unix(0, 0)
+
+	// first ejection: cooldown = base.
+	s.eject(now, cfg)
+	if got := s.ejectedUntil.Sub(now); got != cfg.BaseEjectionDuration {
+		t.Fatalf("1st eject cooldown = %v, want %v", got, cfg.BaseEjectionDuration)
+	}
+
+	// relapsing right as the cooldown expires escalates to double the cooldown.
+	now = s.ejectedUntil
+	s.eject(now, cfg)
+	if got := s.ejectedUntil.Sub(now); got != 2*cfg.BaseEjectionDuration {
+		t.Fatalf("2nd eject cooldown = %v, want %v", got, 2*cfg.BaseEjectionDuration)
+	}
+
+	// a third immediate relapse doubles again; 4s is still below MaxEjectionDuration.
+	now = s.ejectedUntil
+	s.eject(now, cfg)
+	if got := s.ejectedUntil.Sub(now); got != 4*cfg.BaseEjectionDuration {
+		t.Fatalf("3rd eject cooldown = %v, want %v", got, 4*cfg.BaseEjectionDuration)
+	}
+
+	// once the store has stayed healthy for a full cooldown period, the next ejection
+	// is treated as a fresh offence rather than continuing to escalate.
+	now = s.ejectedUntil.Add(cfg.BaseEjectionDuration + time.Millisecond)
+	s.eject(now, cfg)
+	if got := s.ejectedUntil.Sub(now); got != cfg.BaseEjectionDuration {
+		t.Fatalf("eject after healthy period = %v, want %v (reset)", got, cfg.BaseEjectionDuration)
+	}
+}
@@ -15,8 +15,10 @@
 package locate
 
 import (
-	"go.uber.org/atomic"
+	"math/bits"
 	"time"
+
+	"go.uber.org/atomic"
 )
 
 // number of buckets stored in the stats
@@ -29,12 +31,21 @@ const counterMusk uint64 = (1 << counterBytes) - 1
 type latencyStats struct {
 	// each bucket represent the statistics data of 1s, we only keep latest `bucketsCount` data.
 	buckets [bucketsCount]bucket
+	// histBuckets mirrors buckets but keeps a latency histogram instead of a count+sum pair,
+	// so that callers can ask for tail percentiles in addition to the average.
+	histBuckets [bucketsCount]hdrBucket
 }
 
-func (s *latencyStats) observe(now time.Time, val uint64) {
+// observe records one request's latency, in milliseconds, for storeID/regionID. reqType
+// and role (one of "leader", "follower", or "learner") are only used to label the
+// latency reported to the current MetricsSink; they don't affect the in-process
+// buckets/histBuckets stats.
+func (s *latencyStats) observe(now time.Time, storeID, regionID uint64, reqType, role string, ms uint64) {
 	ts := now.Unix()
 	idx := int(ts) % bucketsCount
-	s.buckets[idx].observe(ts, val)
+	s.buckets[idx].observe(ts, ms)
+	s.histBuckets[idx].observe(ts, ms)
+	currentMetricsSink().ObserveLatency(storeID, regionID, reqType, role, ms)
 }
 
 const numOfLastStats int = 5
@@ -42,8 +53,22 @@ const numOfLastStats int = 5
 func (s *latencyStats) getLatestStats(ts time.Time) Stats {
 	res := make(Stats, 0, numOfLastStats)
 	idx := int(ts.Unix()) % bucketsCount
+	merged := &mergedHist{}
+	factor := 1.0
 	for i := 0; i < numOfLastStats; i++ {
-		res = append(res, s.buckets[(idx + bucketsCount - i) % bucketsCount].load())
+		j := (idx + bucketsCount - i) % bucketsCount
+		res = append(res, s.buckets[j].load())
+		// Sum straight into the shared accumulator instead of returning a full
+		// [hdrBucketCount]uint64 snapshot per bucket, which would cost 5 throwaway ~16KB
+		// copies per call.
+		s.histBuckets[j].addWeighted(&merged.unweighted, 1)
+		s.histBuckets[j].addWeighted(&merged.weighted, factor)
+		factor *= attenuateFactor
+	}
+	// Percentile/WeightedPercentile only need the merged histogram once; hang it off the
+	// most recent entry rather than duplicating the pointer on every element.
+	if len(res) > 0 {
+		res[0].hist = merged
 	}
 	return res
 }
@@ -78,6 +103,10 @@ func (b *bucket) load() SingleStat {
 type SingleStat struct {
 	Count uint64
 	Sum   uint64
+	// hist is the latency histogram merged across the whole window passed to
+	// latencyStats.getLatestStats. It is only set on the most recent entry of the
+	// returned Stats (see getLatestStats), and nil otherwise.
+	hist *mergedHist
 }
 
 func (s SingleStat) Avg() uint64 {
@@ -112,4 +141,120 @@ func (s Stats) WeightedAvg() uint64 {
 	return uint64(totalSum / totalCount)
 }
 
+// Percentile returns the p-th percentile latency (0 < p <= 100) observed across the
+// buckets, giving equal weight to every bucket.
+func (s Stats) Percentile(p float64) uint64 {
+	if s.TotalCount() < 100 || len(s) == 0 || s[0].hist == nil {
+		return 0
+	}
+	return percentileOf(&s[0].hist.unweighted, p)
+}
+
+// WeightedPercentile is like Percentile, but applies the same attenuateFactor decay used
+// by WeightedAvg so that older buckets contribute less than the most recent one.
+func (s Stats) WeightedPercentile(p float64) uint64 {
+	if s.TotalCount() < 100 || len(s) == 0 || s[0].hist == nil {
+		return 0
+	}
+	return percentileOf(&s[0].hist.weighted, p)
+}
+
+// mergedHist is the latency histogram merged across the buckets backing a Stats value,
+// built once by getLatestStats rather than allocating a snapshot per bucket. unweighted
+// gives every bucket equal weight; weighted applies the same attenuateFactor decay as
+// WeightedAvg.
+type mergedHist struct {
+	unweighted [hdrBucketCount]float64
+	weighted   [hdrBucketCount]float64
+}
+
+// percentileOf walks a merged histogram and returns the representative latency of the
+// bucket containing the p-th percentile (0 < p <= 100).
+func percentileOf(merged *[hdrBucketCount]float64, p float64) uint64 {
+	total := 0.0
+	for _, c := range merged {
+		total += c
+	}
+	if total <= 0 {
+		return 0
+	}
+	target := total * p / 100.0
+	cum := 0.0
+	for i, c := range merged {
+		cum += c
+		if cum >= target {
+			return hdrBucketValue(i)
+		}
+	}
+	return hdrBucketValue(hdrBucketCount - 1)
+}
+
+// hdrBucketCount is the number of fixed latency buckets kept per 1s window. Buckets are
+// spaced log-linearly in the style of an HDR histogram: values below hdrSubBucketCount
+// are tracked with one bucket per value, and each power-of-two range above that is
+// subdivided into hdrSubBucketCount equal linear steps, bounding the relative error of
+// any reported percentile to roughly 1/hdrSubBucketCount regardless of magnitude. With
+// hdrSubBucketBits = 6 the 2048 buckets cover latencies from 0ms up to 2^37-1ms (observe,
+// and therefore this histogram, always deals in milliseconds) at about 1.5% relative
+// error; 60s already falls in bucket 693, and larger values land in the last bucket.
+const hdrBucketCount int = 2048
+const hdrSubBucketBits uint = 6
+const hdrSubBucketCount uint64 = 1 << hdrSubBucketBits
 
+// hdrBucketIndex maps a latency value to its bucket, see hdrBucketCount for the scheme.
+func hdrBucketIndex(v uint64) int {
+	if v < hdrSubBucketCount {
+		return int(v)
+	}
+	msb := uint(bits.Len64(v)) - 1
+	subIdx := (v - (1 << msb)) >> (msb - hdrSubBucketBits)
+	idx := int((1+msb-hdrSubBucketBits)*uint(hdrSubBucketCount)) + int(subIdx)
+	if idx >= hdrBucketCount {
+		idx = hdrBucketCount - 1
+	}
+	return idx
+}
+
+// hdrBucketValue returns the smallest latency value that maps to bucket idx, used to
+// report a representative value for a percentile.
+func hdrBucketValue(idx int) uint64 {
+	if uint64(idx) < hdrSubBucketCount {
+		return uint64(idx)
+	}
+	octave := uint(idx)/uint(hdrSubBucketCount) - 1
+	subIdx := uint64(idx) % hdrSubBucketCount
+	msb := octave + hdrSubBucketBits
+	return (1 << msb) + (subIdx << (msb - hdrSubBucketBits))
+}
+
+// hdrBucket is the histogram counterpart of bucket: it keeps a full latency distribution
+// for one 1s window instead of just a count and sum.
+type hdrBucket struct {
+	ts     atomic.Int64
+	counts [hdrBucketCount]atomic.Uint64
+}
+
+func (b *hdrBucket) observe(ts int64, v uint64) {
+	oldTs := b.ts.Load()
+	// same lazy-reset trick as bucket.observe: a concurrent Add lost to this Store is an
+	// acceptable loss of precision, not a correctness issue.
+	if oldTs != ts {
+		if b.ts.CAS(oldTs, ts) {
+			for i := range b.counts {
+				b.counts[i].Store(0)
+			}
+		}
+	}
+	b.counts[hdrBucketIndex(v)].Add(1)
+}
+
+// addWeighted adds this bucket's latency histogram into dst, scaling every count by
+// weight. It sums straight into the caller's accumulator rather than returning a
+// snapshot, so merging several buckets doesn't allocate one throwaway copy per bucket.
+func (b *hdrBucket) addWeighted(dst *[hdrBucketCount]float64, weight float64) {
+	for i := range b.counts {
+		if c := b.counts[i].Load(); c != 0 {
+			dst[i] += float64(c) * weight
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import "testing"
+
+func TestHdrBucketIndexValueRoundTrip(t *testing.T) {
+	for idx := 0; idx < hdrBucketCount; idx++ {
+		v := hdrBucketValue(idx)
+		if got := hdrBucketIndex(v); got != idx {
+			t.Fatalf("bucket %d: hdrBucketValue -> %d, hdrBucketIndex -> %d, want %d", idx, v, got, idx)
+		}
+	}
+}
+
+func TestPercentileOfKnownDistribution(t *testing.T) {
+	var merged [hdrBucketCount]float64
+	// 98 samples at 10ms, 2 samples at 1000ms: P50 should land on the bulk of the
+	// distribution, P99 should land on the outlier tail.
+	merged[hdrBucketIndex(10)] = 98
+	merged[hdrBucketIndex(1000)] = 2
+
+	if got := percentileOf(&merged, 50); got != hdrBucketValue(hdrBucketIndex(10)) {
+		t.Errorf("P50 = %d, want %d", got, hdrBucketValue(hdrBucketIndex(10)))
+	}
+	if got := percentileOf(&merged, 99); got != hdrBucketValue(hdrBucketIndex(1000)) {
+		t.Errorf("P99 = %d, want %d", got, hdrBucketValue(hdrBucketIndex(1000)))
+	}
+}